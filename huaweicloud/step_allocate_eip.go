@@ -0,0 +1,234 @@
+package huaweicloud
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/networks"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepAllocateEIP allocates (or reuses an existing unassociated) HuaweiCloud
+// EIP and associates it with the source server's port, so a server on a
+// private-only network can still be reached over SSH/WinRM.
+type StepAllocateEIP struct {
+	FloatingIP        string
+	FloatingIPNetwork string
+	FloatingIPPool    string
+	ReuseIPs          bool
+
+	floatingIP *floatingips.FloatingIP
+	reused     bool
+}
+
+func (s *StepAllocateEIP) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	server := state.Get("server").(*servers.Server)
+	ui := state.Get("ui").(packer.Ui)
+
+	if s.FloatingIP == "" && s.FloatingIPNetwork == "" && s.FloatingIPPool == "" {
+		return multistep.ActionContinue
+	}
+
+	networkClient, err := config.networkV2Client()
+	if err != nil {
+		err = fmt.Errorf("Error initializing network client: %s", err)
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	var fip *floatingips.FloatingIP
+
+	if s.FloatingIP != "" {
+		// The user already owns the EIP; look it up so we know whether it
+		// needs to be associated and whether Cleanup should leave it alone.
+		fip, err = floatingIPByAddress(networkClient, s.FloatingIP)
+		if err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+		s.reused = true
+	} else if s.ReuseIPs {
+		fip, err = unassociatedFloatingIP(networkClient, s.FloatingIPNetwork, s.FloatingIPPool)
+		if err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+		if fip != nil {
+			s.reused = true
+		}
+	}
+
+	if fip == nil {
+		poolID, err := floatingIPPoolID(networkClient, s.FloatingIPNetwork, s.FloatingIPPool)
+		if err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+
+		ui.Say("Allocating a floating IP...")
+		fip, err = floatingips.Create(networkClient, floatingips.CreateOpts{
+			FloatingNetworkID: poolID,
+		}).Extract()
+		if err != nil {
+			err = fmt.Errorf("Error allocating floating IP: %s", err)
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+	}
+
+	portID, err := serverPortID(networkClient, server.ID)
+	if err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	// Reassociate whenever the floating IP isn't already bound to this
+	// server's port, whether it's currently unbound or left over from a
+	// stale association (e.g. a prior run, or another build that released
+	// it back to the pool without clearing its port binding).
+	if fip.PortID != portID {
+		ui.Say(fmt.Sprintf("Associating floating IP %s with the source server...", fip.FloatingIP))
+		fip, err = floatingips.Update(networkClient, fip.ID, floatingips.UpdateOpts{
+			PortID: &portID,
+		}).Extract()
+		if err != nil {
+			err = fmt.Errorf("Error associating floating IP: %s", err)
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+	}
+
+	s.floatingIP = fip
+	state.Put("access_ip", fip.FloatingIP)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepAllocateEIP) Cleanup(state multistep.StateBag) {
+	if s.floatingIP == nil || s.reused {
+		return
+	}
+
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	networkClient, err := config.networkV2Client()
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error releasing floating IP, may still be around: %s", err))
+		return
+	}
+
+	ui.Say(fmt.Sprintf("Releasing the floating IP: %s ...", s.floatingIP.FloatingIP))
+	if err := floatingips.Delete(networkClient, s.floatingIP.ID).ExtractErr(); err != nil {
+		ui.Error(fmt.Sprintf("Error releasing floating IP, may still be around: %s", err))
+	}
+}
+
+// floatingIPByAddress looks up an existing EIP by its public address.
+func floatingIPByAddress(client *gophercloud.ServiceClient, address string) (*floatingips.FloatingIP, error) {
+	pages, err := floatingips.List(client, floatingips.ListOpts{FloatingIP: address}).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing floating IPs: %s", err)
+	}
+
+	all, err := floatingips.ExtractFloatingIPs(pages)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing floating IPs: %s", err)
+	}
+
+	if len(all) == 0 {
+		return nil, fmt.Errorf("Floating IP %q was not found", address)
+	}
+
+	return &all[0], nil
+}
+
+// unassociatedFloatingIP returns an existing EIP in network/pool that isn't
+// bound to a port yet, or nil if none is available. network takes
+// precedence over pool, mirroring floatingIPPoolID.
+func unassociatedFloatingIP(client *gophercloud.ServiceClient, network, pool string) (*floatingips.FloatingIP, error) {
+	opts := floatingips.ListOpts{}
+	if network != "" || pool != "" {
+		poolID, err := floatingIPPoolID(client, network, pool)
+		if err != nil {
+			return nil, err
+		}
+		opts.FloatingNetworkID = poolID
+	}
+
+	pages, err := floatingips.List(client, opts).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing floating IPs: %s", err)
+	}
+
+	all, err := floatingips.ExtractFloatingIPs(pages)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing floating IPs: %s", err)
+	}
+
+	for i := range all {
+		if all[i].PortID == "" {
+			return &all[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// floatingIPPoolID resolves the external network to allocate the EIP from,
+// preferring an explicit network ID/name over the legacy pool name.
+func floatingIPPoolID(client *gophercloud.ServiceClient, network, pool string) (string, error) {
+	name := network
+	if name == "" {
+		name = pool
+	}
+	if name == "" {
+		return "", fmt.Errorf("floating_ip_network or floating_ip_pool must be set to allocate a new floating IP")
+	}
+
+	for _, opts := range []networks.ListOpts{{Name: name}, {ID: name}} {
+		pages, err := networks.List(client, opts).AllPages()
+		if err != nil {
+			return "", fmt.Errorf("Error listing networks: %s", err)
+		}
+
+		all, err := networks.ExtractNetworks(pages)
+		if err != nil {
+			return "", fmt.Errorf("Error listing networks: %s", err)
+		}
+
+		for _, n := range all {
+			if n.ID == name || n.Name == name {
+				return n.ID, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("External network %q was not found", name)
+}
+
+// serverPortID returns the ID of the server's first port, which the
+// floating IP is associated with.
+func serverPortID(client *gophercloud.ServiceClient, serverID string) (string, error) {
+	pages, err := ports.List(client, ports.ListOpts{DeviceID: serverID}).AllPages()
+	if err != nil {
+		return "", fmt.Errorf("Error listing server ports: %s", err)
+	}
+
+	all, err := ports.ExtractPorts(pages)
+	if err != nil {
+		return "", fmt.Errorf("Error listing server ports: %s", err)
+	}
+
+	if len(all) == 0 {
+		return "", fmt.Errorf("No port found for server %s", serverID)
+	}
+
+	return all[0].ID, nil
+}
@@ -0,0 +1,147 @@
+package huaweicloud
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
+	"github.com/hashicorp/packer/common/uuid"
+	"github.com/hashicorp/packer/helper/communicator"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+	"golang.org/x/crypto/ssh"
+)
+
+// generateKeyPair creates a fresh ed25519 keypair, returning the public key
+// in authorized_keys format and the private key PEM-encoded. Generating the
+// key locally (rather than asking Nova to generate one) lets us use
+// ed25519, since the keypairs extension's server-side generation is RSA
+// only.
+func generateKeyPair() (publicKey string, privateKeyPEM []byte, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error generating keypair: %s", err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error encoding public key: %s", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return "", nil, fmt.Errorf("Error encoding private key: %s", err)
+	}
+
+	return string(ssh.MarshalAuthorizedKey(sshPub)), pem.EncodeToMemory(block), nil
+}
+
+// StepKeyPair generates a temporary ed25519 keypair for the build when the
+// user hasn't configured one, so a region doesn't need a pre-existing
+// keypair for Packer to be able to SSH/WinRM into the source server.
+type StepKeyPair struct {
+	Debug        bool
+	Comm         *communicator.Config
+	DebugKeyPath string
+
+	doCleanup bool
+}
+
+func (s *StepKeyPair) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	if s.Comm.SSHPrivateKeyFile != "" {
+		ui.Say("Using existing SSH private key")
+		privateKeyBytes, err := s.Comm.ReadSSHPrivateKeyFile()
+		if err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+
+		s.Comm.SSHPrivateKey = privateKeyBytes
+
+		return multistep.ActionContinue
+	}
+
+	if s.Comm.SSHAgentAuth && s.Comm.SSHKeyPairName != "" {
+		ui.Say(fmt.Sprintf("Using SSH Agent for existing key pair %s", s.Comm.SSHKeyPairName))
+		return multistep.ActionContinue
+	}
+
+	if s.Comm.SSHKeyPairName != "" {
+		// The user already owns a keypair in this region; StepRunSourceServer
+		// reads config.Comm.SSHKeyPairName directly, so there's nothing to do.
+		return multistep.ActionContinue
+	}
+
+	config := state.Get("config").(*Config)
+
+	computeClient, err := config.computeV2Client()
+	if err != nil {
+		err = fmt.Errorf("Error initializing compute client: %s", err)
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	publicKey, privateKeyPEM, err := generateKeyPair()
+	if err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	name := fmt.Sprintf("packer_%s", uuid.TimeOrderedUUID())
+
+	ui.Say(fmt.Sprintf("Creating temporary keypair: %s ...", name))
+	keyPair, err := keypairs.Create(computeClient, keypairs.CreateOpts{
+		Name:      name,
+		PublicKey: publicKey,
+	}).Extract()
+	if err != nil {
+		err = fmt.Errorf("Error creating temporary keypair: %s", err)
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	s.doCleanup = true
+
+	s.Comm.SSHKeyPairName = keyPair.Name
+	s.Comm.SSHPrivateKey = privateKeyPEM
+
+	state.Put("ssh_key_pair_name", keyPair.Name)
+	state.Put("ssh_public_key", publicKey)
+
+	if s.Debug {
+		ui.Message(fmt.Sprintf("Saving key for debug purposes: %s", s.DebugKeyPath))
+		if err := ioutil.WriteFile(s.DebugKeyPath, privateKeyPEM, 0600); err != nil {
+			err = fmt.Errorf("Error saving debug key: %s", err)
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepKeyPair) Cleanup(state multistep.StateBag) {
+	if !s.doCleanup {
+		return
+	}
+
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	computeClient, err := config.computeV2Client()
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error cleaning up keypair, may still be around: %s", err))
+		return
+	}
+
+	ui.Say(fmt.Sprintf("Deleting temporary keypair: %s ...", s.Comm.SSHKeyPairName))
+	if err := keypairs.Delete(computeClient, s.Comm.SSHKeyPairName).ExtractErr(); err != nil {
+		ui.Error(fmt.Sprintf("Error cleaning up keypair, may still be around: %s", err))
+	}
+}
@@ -1,32 +1,250 @@
 package huaweicloud
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v2/volumes"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/bootfromvolume"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/schedulerhints"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
 	"github.com/hashicorp/packer/helper/multistep"
 	"github.com/hashicorp/packer/packer"
 )
 
+// maxUserDataSize is the maximum size, in raw bytes, that Nova/HuaweiCloud
+// ECS accepts for user data. Larger payloads are gzip-compressed before
+// being submitted.
+const maxUserDataSize = 65536
+
+// PersonalityFile injects a file into the source server's filesystem at
+// boot via the compute service's personality mechanism. Exactly one of
+// Contents or Source should be set.
+type PersonalityFile struct {
+	Path     string
+	Contents string
+	Source   string
+}
+
 type StepRunSourceServer struct {
-	Name                  string
-	SecurityGroups        []string
-	Networks              []string
-	Ports                 []string
-	AvailabilityZone      string
-	UserData              string
-	UserDataFile          string
+	Name             string
+	SecurityGroups   []string
+	Networks         []string
+	Ports            []string
+	AvailabilityZone string
+	UserData         string
+	UserDataFile     string
+	// TemplateUserData opts into rendering UserData/UserDataFile through
+	// text/template before it's submitted. Off by default because cloud-init
+	// itself uses the same "{{ ... }}" delimiters for its own Jinja
+	// templating ("## template: jinja" user data), which this would break.
+	TemplateUserData      bool
 	ConfigDrive           bool
 	InstanceMetadata      map[string]string
 	UseBlockStorageVolume bool
 	ForceDelete           bool
-	server                *servers.Server
+	Personality           []PersonalityFile
+
+	// RootVolume, when set, causes the server's system disk to be created
+	// directly as an EVS volume via the compute service's block device
+	// mapping v2 API, instead of requiring a prior volume-creation step.
+	RootVolume *BlockDeviceMapping
+	// DataVolumes are additional, non-boot EVS volumes attached to the
+	// server at creation time. They are only attached when RootVolume is
+	// set; otherwise they are ignored.
+	DataVolumes []BlockDeviceMapping
+
+	// Scheduler hints let a build be pinned to, or spread across, specific
+	// hypervisors or server groups. They are only applied when at least one
+	// of them is set.
+	SchedulerHintGroup           string
+	SchedulerHintDifferentHost   []string
+	SchedulerHintSameHost        []string
+	SchedulerHintQuery           []interface{}
+	SchedulerHintTargetCell      string
+	SchedulerHintBuildNearHostIP string
+	SchedulerHintCidr            string
+
+	server *servers.Server
+}
+
+// BlockDeviceMapping describes a single EVS volume to attach to the source
+// server through the compute service's block device mapping v2 API.
+type BlockDeviceMapping struct {
+	// SourceType is one of "image", "snapshot", "volume", or "blank".
+	SourceType string
+	// VolumeSize is the size of the volume, in GB. Ignored when SourceType
+	// is "volume", since the volume already has a size.
+	VolumeSize int
+	// VolumeType is the EVS disk type, e.g. "SATA", "SSD", or "SAS".
+	VolumeType string
+	// VolumeAvailabilityZone pins the volume to a specific AZ. The BDM v2
+	// API gophercloud exposes (bootfromvolume.BlockDevice) has no per-entry
+	// AZ field, so when this is set the step pre-creates the volume via the
+	// Block Storage service in this AZ and references it as a "volume"
+	// source instead of letting Nova create it inline; see
+	// materializeVolumeAZ.
+	VolumeAvailabilityZone string
+	// UUID is the image, snapshot, or volume ID to create the volume from.
+	// Unused when SourceType is "blank".
+	UUID string
+	// DeleteOnTermination controls whether the volume is deleted when the
+	// server it's attached to is deleted.
+	DeleteOnTermination bool
+}
+
+// toBlockDevice converts a BlockDeviceMapping into the gophercloud type
+// expected by the bootfromvolume extension, assigning it the given boot
+// index ("0" is the boot/root device, "-1" a non-boot data volume).
+func toBlockDevice(bd BlockDeviceMapping, bootIndex int) bootfromvolume.BlockDevice {
+	var sourceType bootfromvolume.SourceType
+	switch bd.SourceType {
+	case "image":
+		sourceType = bootfromvolume.SourceImage
+	case "snapshot":
+		sourceType = bootfromvolume.SourceSnapshot
+	case "volume":
+		sourceType = bootfromvolume.SourceVolume
+	default:
+		sourceType = bootfromvolume.SourceBlank
+	}
+
+	return bootfromvolume.BlockDevice{
+		BootIndex:           bootIndex,
+		DestinationType:     bootfromvolume.DestinationVolume,
+		SourceType:          sourceType,
+		UUID:                bd.UUID,
+		VolumeSize:          bd.VolumeSize,
+		VolumeType:          bd.VolumeType,
+		DeleteOnTermination: bd.DeleteOnTermination,
+	}
+}
+
+// materializeVolumeAZ pre-creates bd's volume via the Block Storage service
+// when a VolumeAvailabilityZone is requested, and returns a mapping that
+// references the resulting volume instead of the original image/snapshot/
+// blank source. It waits for the volume to become available before
+// returning so the BDM entry can safely reference it. bd is returned
+// unchanged when no AZ is requested, or when it already references an
+// existing volume.
+func materializeVolumeAZ(blockStorageClient *gophercloud.ServiceClient, bd BlockDeviceMapping) (BlockDeviceMapping, error) {
+	if bd.VolumeAvailabilityZone == "" || bd.SourceType == "volume" {
+		return bd, nil
+	}
+
+	createOpts := volumes.CreateOpts{
+		Size:             bd.VolumeSize,
+		VolumeType:       bd.VolumeType,
+		AvailabilityZone: bd.VolumeAvailabilityZone,
+	}
+	switch bd.SourceType {
+	case "image":
+		createOpts.ImageID = bd.UUID
+	case "snapshot":
+		createOpts.SnapshotID = bd.UUID
+	}
+
+	volume, err := volumes.Create(blockStorageClient, createOpts).Extract()
+	if err != nil {
+		return bd, fmt.Errorf("Error creating volume in az %q: %s", bd.VolumeAvailabilityZone, err)
+	}
+
+	stateChange := StateChangeConf{
+		Pending: []string{"creating", "downloading"},
+		Target:  []string{"available"},
+		Refresh: VolumeStateRefreshFunc(blockStorageClient, volume.ID),
+	}
+	if _, err := WaitForState(&stateChange); err != nil {
+		return bd, fmt.Errorf("Error waiting for volume %s to become available: %s", volume.ID, err)
+	}
+
+	return BlockDeviceMapping{
+		SourceType:          "volume",
+		UUID:                volume.ID,
+		DeleteOnTermination: bd.DeleteOnTermination,
+	}, nil
+}
+
+// userDataTemplateData is the set of values available to a user data file
+// via {{ .SSHPublicKey }}/{{ .WinRMPassword }} templating.
+type userDataTemplateData struct {
+	SSHPublicKey  string
+	WinRMPassword string
+}
+
+// renderUserData runs the raw user data through text/template, making the
+// communicator's generated SSH public key and WinRM password available to
+// cloud-init so it can provision the matching user account.
+func renderUserData(config *Config, state multistep.StateBag, raw []byte) ([]byte, error) {
+	tmpl, err := template.New("user_data").Parse(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing user data template: %s", err)
+	}
+
+	data := userDataTemplateData{
+		WinRMPassword: config.Comm.WinRMPassword,
+	}
+	if raw, ok := state.GetOk("ssh_public_key"); ok {
+		data.SSHPublicKey = raw.(string)
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, fmt.Errorf("Error rendering user data template: %s", err)
+	}
+
+	return out.Bytes(), nil
+}
+
+// gzipUserData compresses user data that's too large for Nova to accept
+// raw. HuaweiCloud/OpenStack Nova transparently gunzips user data whose
+// first bytes are a gzip magic number.
+func gzipUserData(raw []byte) ([]byte, error) {
+	var out bytes.Buffer
+	w := gzip.NewWriter(&out)
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// hasSchedulerHints reports whether any scheduler hint was configured.
+func (s *StepRunSourceServer) hasSchedulerHints() bool {
+	return s.SchedulerHintGroup != "" ||
+		len(s.SchedulerHintDifferentHost) > 0 ||
+		len(s.SchedulerHintSameHost) > 0 ||
+		len(s.SchedulerHintQuery) > 0 ||
+		s.SchedulerHintTargetCell != "" ||
+		s.SchedulerHintBuildNearHostIP != "" ||
+		s.SchedulerHintCidr != ""
+}
+
+// buildNearHostIP joins the build_near_host_ip/cidr config values into the
+// single "ip/cidr" string gophercloud's schedulerhints.SchedulerHints
+// expects in its BuildNearHostIP field (it parses the CIDR out of that
+// string internally rather than taking it as a separate field).
+func (s *StepRunSourceServer) buildNearHostIP() string {
+	if s.SchedulerHintBuildNearHostIP == "" {
+		return ""
+	}
+	if s.SchedulerHintCidr == "" {
+		return s.SchedulerHintBuildNearHostIP
+	}
+	return fmt.Sprintf("%s/%s", s.SchedulerHintBuildNearHostIP, s.SchedulerHintCidr)
 }
 
 func (s *StepRunSourceServer) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -62,6 +280,50 @@ func (s *StepRunSourceServer) Run(ctx context.Context, state multistep.StateBag)
 		}
 	}
 
+	if len(userData) > 0 {
+		if s.TemplateUserData {
+			userData, err = renderUserData(config, state, userData)
+			if err != nil {
+				state.Put("error", err)
+				return multistep.ActionHalt
+			}
+		}
+
+		if len(userData) > maxUserDataSize {
+			userData, err = gzipUserData(userData)
+			if err != nil {
+				err = fmt.Errorf("Error compressing user data: %s", err)
+				state.Put("error", err)
+				return multistep.ActionHalt
+			}
+
+			if len(userData) > maxUserDataSize {
+				err = fmt.Errorf(
+					"User data is %d bytes after gzip compression, still over the %d byte limit Nova enforces",
+					len(userData), maxUserDataSize)
+				state.Put("error", err)
+				return multistep.ActionHalt
+			}
+		}
+	}
+
+	var personality servers.Personality
+	for _, pf := range s.Personality {
+		contents := []byte(pf.Contents)
+		if pf.Source != "" {
+			contents, err = ioutil.ReadFile(pf.Source)
+			if err != nil {
+				err = fmt.Errorf("Error reading personality file %q: %s", pf.Source, err)
+				state.Put("error", err)
+				return multistep.ActionHalt
+			}
+		}
+		personality = append(personality, &servers.File{
+			Path:     pf.Path,
+			Contents: contents,
+		})
+	}
+
 	serverOpts := servers.CreateOpts{
 		Name:             s.Name,
 		ImageRef:         sourceImage,
@@ -73,13 +335,47 @@ func (s *StepRunSourceServer) Run(ctx context.Context, state multistep.StateBag)
 		ConfigDrive:      &s.ConfigDrive,
 		ServiceClient:    computeClient,
 		Metadata:         s.InstanceMetadata,
+		Personality:      personality,
 	}
 
 	var serverOptsExt servers.CreateOptsBuilder
 
 	// Create root volume in the Block Storage service if required.
 	// Add block device mapping v2 to the server create options if required.
-	if s.UseBlockStorageVolume {
+	switch {
+	case s.RootVolume != nil:
+		// The root volume is declared inline, so the step builds the full
+		// block device mapping itself instead of depending on a separate
+		// volume-creation step.
+		blockStorageClient, err := config.blockStorageV2Client()
+		if err != nil {
+			err = fmt.Errorf("Error initializing block storage client: %s", err)
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+
+		rootVolume, err := materializeVolumeAZ(blockStorageClient, *s.RootVolume)
+		if err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+		blockDeviceMappingV2 := []bootfromvolume.BlockDevice{toBlockDevice(rootVolume, 0)}
+		for _, dv := range s.DataVolumes {
+			dv, err = materializeVolumeAZ(blockStorageClient, dv)
+			if err != nil {
+				state.Put("error", err)
+				return multistep.ActionHalt
+			}
+			blockDeviceMappingV2 = append(blockDeviceMappingV2, toBlockDevice(dv, -1))
+		}
+		// ImageRef and block device mapping is an invalid options combination;
+		// Nova derives the image from the boot-index-0 BDM entry's UUID instead.
+		serverOpts.ImageRef = ""
+		serverOptsExt = bootfromvolume.CreateOptsExt{
+			CreateOptsBuilder: &serverOpts, // must pass pointer, because it will be changed later
+			BlockDevice:       blockDeviceMappingV2,
+		}
+	case s.UseBlockStorageVolume:
 		volume := state.Get("volume_id").(string)
 		blockDeviceMappingV2 := []bootfromvolume.BlockDevice{
 			{
@@ -95,7 +391,7 @@ func (s *StepRunSourceServer) Run(ctx context.Context, state multistep.StateBag)
 			CreateOptsBuilder: &serverOpts, // must pass pointer, because it will be changed later
 			BlockDevice:       blockDeviceMappingV2,
 		}
-	} else {
+	default:
 		serverOptsExt = &serverOpts // must pass pointer
 	}
 
@@ -108,6 +404,22 @@ func (s *StepRunSourceServer) Run(ctx context.Context, state multistep.StateBag)
 		}
 	}
 
+	// Add scheduler hints to the server create options so the build can be
+	// pinned to a host/cell or spread across a server group.
+	if s.hasSchedulerHints() {
+		serverOptsExt = schedulerhints.CreateOptsExt{
+			CreateOptsBuilder: serverOptsExt,
+			SchedulerHints: schedulerhints.SchedulerHints{
+				Group:           s.SchedulerHintGroup,
+				DifferentHost:   s.SchedulerHintDifferentHost,
+				SameHost:        s.SchedulerHintSameHost,
+				Query:           s.SchedulerHintQuery,
+				TargetCell:      s.SchedulerHintTargetCell,
+				BuildNearHostIP: s.buildNearHostIP(),
+			},
+		}
+	}
+
 	azs := state.Get("azs").([]string)
 	if s.AvailabilityZone != "" {
 		for i, az := range azs {
@@ -175,8 +487,75 @@ func (s *StepRunSourceServer) Cleanup(state multistep.StateBag) {
 	WaitForState(&stateChange)
 }
 
+// defaultInstanceCreateRetries/Backoff are used when the user doesn't
+// configure instance_create_retries/instance_create_backoff.
+const (
+	defaultInstanceCreateRetries = 3
+	defaultInstanceCreateBackoff = 5 * time.Second
+)
+
+// retryableCreateErrorSubstrings are HuaweiCloud-specific error messages,
+// beyond the gophercloud error types handled explicitly, that indicate a
+// transient capacity problem worth retrying rather than a hard failure.
+var retryableCreateErrorSubstrings = []string{
+	"Quota exceeded",
+	"No valid host was found",
+	"not available in the specified availability zone",
+}
+
+// isRetryableCreateError reports whether err looks like a transient quota
+// or capacity problem that's worth retrying within the current AZ, rather
+// than a fatal misconfiguration.
+func isRetryableCreateError(err error) bool {
+	switch err.(type) {
+	case gophercloud.ErrDefault409, gophercloud.ErrDefault500, gophercloud.ErrDefault503:
+		return true
+	}
+
+	msg := err.Error()
+	for _, s := range retryableCreateErrorSubstrings {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// createServerWithRetry calls servers.Create, retrying with exponential
+// backoff and jitter on transient quota/capacity errors. A retryable error
+// is returned, so the caller falls through to the next availability zone,
+// only once retries are exhausted; any other error is returned at once.
+func createServerWithRetry(ui packer.Ui, client *gophercloud.ServiceClient, opts servers.CreateOptsBuilder, retries int, backoff time.Duration) (*servers.Server, error) {
+	if retries <= 0 {
+		retries = defaultInstanceCreateRetries
+	}
+	if backoff <= 0 {
+		backoff = defaultInstanceCreateBackoff
+	}
+
+	var server *servers.Server
+	var err error
+	for attempt := 0; ; attempt++ {
+		server, err = servers.Create(client, opts).Extract()
+		if err == nil {
+			return server, nil
+		}
+		if attempt >= retries || !isRetryableCreateError(err) {
+			return nil, err
+		}
+
+		wait := backoff * time.Duration(int64(1)<<uint(attempt))
+		wait += time.Duration(rand.Int63n(int64(backoff)))
+		ui.Message(fmt.Sprintf("Server launch failed with a retryable error, retrying in %s: %s", wait, err))
+		time.Sleep(wait)
+	}
+}
+
 func createServer(ui packer.Ui, state multistep.StateBag, client *gophercloud.ServiceClient, opts servers.CreateOptsBuilder) (*servers.Server, error) {
-	server, err := servers.Create(client, opts).Extract()
+	config := state.Get("config").(*Config)
+
+	server, err := createServerWithRetry(ui, client, opts, config.InstanceCreateRetries, config.InstanceCreateBackoff)
 	if err != nil {
 		err = fmt.Errorf("Error launching source server: %s", err)
 		ui.Error(err.Error())